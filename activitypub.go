@@ -0,0 +1,481 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twinj/uuid"
+	"gitlab.com/xojoc/util"
+)
+
+const (
+	keysBucket      = "keys"
+	followersBucket = "followers"
+	privateKeyKey   = "private_key"
+
+	outboxPageSize = 20
+
+	// maxFollowers caps how many actors handleFollow will register.
+	// Inbound Follow/Undo aren't signature-verified (see inboxHandler),
+	// so anyone can claim any actor IRI; without a cap, that lets a
+	// single requester register unbounded followers and turn this
+	// server into an open relay that fans out a signed POST per paste
+	// to every inbox they named.
+	maxFollowers = 1000
+)
+
+var errTooManyFollowers = errors.New("too many followers")
+
+var actorKey *rsa.PrivateKey
+
+// httpClient is used for every outgoing request to an address named
+// by an inbound activity (an actor IRI to follow, a follower's
+// inbox), so it dials through the same guardedDialContext chunk0-5
+// uses for /import rather than trusting whatever a stranger on the
+// Fediverse hands us.
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: guardedDialContext,
+	},
+}
+
+// initActivityPub creates the buckets the ActivityPub actor needs and
+// loads (or generates) its signing key. It's called from main.go's
+// init, after boltdb has been opened.
+func initActivityPub() {
+	boltdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{keysBucket, followersBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			util.Fatal(err)
+		}
+		return nil
+	})
+
+	var err error
+	actorKey, err = loadOrCreateActorKey()
+	util.Fatal(err)
+}
+
+// loadOrCreateActorKey returns the RSA key used to sign outgoing
+// activities, generating and persisting one on first startup.
+func loadOrCreateActorKey() (*rsa.PrivateKey, error) {
+	var der []byte
+	err := boltdb.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(keysBucket)).Get([]byte(privateKeyKey))
+		if v != nil {
+			der = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if der != nil {
+		return x509.ParsePKCS1PrivateKey(der)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der = x509.MarshalPKCS1PrivateKey(key)
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(keysBucket)).Put([]byte(privateKeyKey), der)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func publicKeyPEM(key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// apActor is the site's single ActivityPub actor: a Service
+// publishing every paste as a Note.
+type apActor struct {
+	Context           []string    `json:"@context"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	PublicKey         apPublicKey `json:"publicKey"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apNote struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	AttributedTo string   `json:"attributedTo"`
+	Content      string   `json:"content"`
+	To           []string `json:"to"`
+}
+
+type apActivity struct {
+	Context string      `json:"@context"`
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Actor   string      `json:"actor"`
+	Object  interface{} `json:"object"`
+	To      []string    `json:"to,omitempty"`
+}
+
+// apInboxActivity is just enough of an incoming activity to dispatch
+// on its type; Object is kept raw since Follow and Undo carry very
+// different payloads there.
+type apInboxActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apOrderedCollection struct {
+	Context      string       `json:"@context"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	TotalItems   int          `json:"totalItems"`
+	OrderedItems []apActivity `json:"orderedItems"`
+}
+
+type webfingerResponse struct {
+	Subject string          `json:"subject"`
+	Links   []webfingerLink `json:"links"`
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type"`
+	Href string `json:"href"`
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func actorID(r *http.Request) string {
+	return baseURL(r) + "/actor"
+}
+
+func noteForArticle(r *http.Request, a *Article) apNote {
+	html, _ := a.ToHTML()
+	return apNote{
+		ID:           baseURL(r) + a.AbsPath(),
+		Type:         "Note",
+		AttributedTo: actorID(r),
+		Content:      string(html),
+		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+	}
+}
+
+func articleCreateActivity(r *http.Request, a *Article) apActivity {
+	note := noteForArticle(r, a)
+	return apActivity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      note.ID + "/activity",
+		Type:    "Create",
+		Actor:   actorID(r),
+		Object:  note,
+		To:      []string{"https://www.w3.org/ns/activitystreams#Public"},
+	}
+}
+
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
+func jsonWrite(w http.ResponseWriter, v interface{}) *NetError {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return &NetError{500, err.Error()}
+	}
+	return nil
+}
+
+func webfingerHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	resource := r.URL.Query().Get("resource")
+	expected := "acct:typed@" + r.Host
+	if resource != expected {
+		return &NetError{404, "unknown resource"}
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	return jsonWrite(w, webfingerResponse{
+		Subject: expected,
+		Links: []webfingerLink{
+			{Rel: "self", Type: "application/activity+json", Href: actorID(r)},
+		},
+	})
+}
+
+func actorHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	pub, err := publicKeyPEM(actorKey)
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	id := actorID(r)
+	w.Header().Set("Content-Type", "application/activity+json")
+	return jsonWrite(w, apActor{
+		Context:           []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"},
+		ID:                id,
+		Type:              "Service",
+		PreferredUsername: "typed",
+		Inbox:             baseURL(r) + "/inbox",
+		Outbox:            baseURL(r) + "/outbox",
+		PublicKey: apPublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: pub,
+		},
+	})
+}
+
+func outboxHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	var articles []*Article
+	err := articleStore.Iterate(func(a *Article) error {
+		if isPrivateByExpiry(a) {
+			return nil
+		}
+		articles = append(articles, a)
+		return nil
+	})
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	sort.Slice(articles, func(i, j int) bool { return articles[i].ID > articles[j].ID })
+	if len(articles) > outboxPageSize {
+		articles = articles[:outboxPageSize]
+	}
+
+	items := make([]apActivity, 0, len(articles))
+	for _, a := range articles {
+		items = append(items, articleCreateActivity(r, a))
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	return jsonWrite(w, apOrderedCollection{
+		Context:      "https://www.w3.org/ns/activitystreams",
+		ID:           baseURL(r) + "/outbox",
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	})
+}
+
+// inboxHandler dispatches inbound activities. It does not verify the
+// HTTP Signature on the request, so it takes act.Actor and act.Object
+// on faith; anyone can POST a Follow claiming to be any actor IRI, or
+// an Undo to rewrite any actor's follower entry. HTTP Signature
+// verification is a required follow-up before this ships for real
+// federation, not an optional hardening pass — maxFollowers below
+// only bounds the damage (relaying signed pastes to attacker-chosen
+// inboxes) in the meantime, it doesn't fix the trust problem.
+func inboxHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	if r.Method != "POST" {
+		return &NetError{500, "can't handle verb"}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, postLimit))
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	var act apInboxActivity
+	if err := json.Unmarshal(body, &act); err != nil {
+		return &NetError{500, err.Error()}
+	}
+
+	switch act.Type {
+	case "Follow":
+		return handleFollow(w, r, act)
+	case "Undo":
+		return handleUndo(w, r, act)
+	default:
+		w.WriteHeader(202)
+		return nil
+	}
+}
+
+func handleFollow(w http.ResponseWriter, r *http.Request, act apInboxActivity) *NetError {
+	inbox, err := fetchActorInbox(act.Actor)
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(followersBucket))
+		if b.Get([]byte(act.Actor)) == nil && b.Stats().KeyN >= maxFollowers {
+			return errTooManyFollowers
+		}
+		return b.Put([]byte(act.Actor), []byte(inbox))
+	})
+	if err == errTooManyFollowers {
+		return &NetError{429, err.Error()}
+	}
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+
+	accept := apActivity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		ID:      actorID(r) + "/accepts/" + uuid.NewV4().String(),
+		Type:    "Accept",
+		Actor:   actorID(r),
+		Object:  act,
+	}
+	keyID := actorID(r) + "#main-key"
+	go func() {
+		if err := deliverActivity(inbox, keyID, accept); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	w.WriteHeader(202)
+	return nil
+}
+
+func handleUndo(w http.ResponseWriter, r *http.Request, act apInboxActivity) *NetError {
+	var inner apInboxActivity
+	if len(act.Object) > 0 {
+		if err := json.Unmarshal(act.Object, &inner); err != nil {
+			return &NetError{500, err.Error()}
+		}
+	}
+	if inner.Type == "Follow" {
+		err := boltdb.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(followersBucket)).Delete([]byte(act.Actor))
+		})
+		if err != nil {
+			return &NetError{500, err.Error()}
+		}
+	}
+	w.WriteHeader(202)
+	return nil
+}
+
+// fetchActorInbox dereferences an actor IRI to learn its inbox URL,
+// so Follow requests can be answered without the follower having to
+// tell us its inbox directly.
+func fetchActorInbox(actorIRI string) (string, error) {
+	req, err := http.NewRequest("GET", actorIRI, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var actor apActor
+	if err := json.NewDecoder(resp.Body).Decode(&actor); err != nil {
+		return "", err
+	}
+	if actor.Inbox == "" {
+		return "", errors.New("actor has no inbox")
+	}
+	return actor.Inbox, nil
+}
+
+// signRequest adds a Date, Digest and HTTP Signature header to req so
+// the receiving inbox can verify it came from our actor key.
+func signRequest(req *http.Request, body []byte, keyID string) error {
+	now := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", now)
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	signingString := fmt.Sprintf(
+		"(request-target): %s %s\nhost: %s\ndate: %s\ndigest: %s",
+		strings.ToLower(req.Method), req.URL.RequestURI(), req.Host, now, req.Header.Get("Digest"),
+	)
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, actorKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="%s"`,
+		keyID, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+func deliverActivity(inboxURL, keyID string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", inboxURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	if err := signRequest(req, body, keyID); err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery to %s failed: %s", inboxURL, resp.Status)
+	}
+	return nil
+}
+
+// deliverToFollowers signs and delivers activity to every follower's
+// inbox in the background so publishing a paste never waits on
+// however many subscribers the site has.
+func deliverToFollowers(r *http.Request, activity interface{}) {
+	keyID := actorID(r) + "#main-key"
+	var inboxes []string
+	err := boltdb.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(followersBucket)).ForEach(func(_, v []byte) error {
+			inboxes = append(inboxes, string(v))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, inbox := range inboxes {
+		go func(inbox string) {
+			if err := deliverActivity(inbox, keyID, activity); err != nil {
+				log.Print(err)
+			}
+		}(inbox)
+	}
+}
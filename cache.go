@@ -0,0 +1,227 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// responseGzipThreshold gates transparent gzip of HTTP responses. It's
+// deliberately separate from gzipThreshold, which governs compression
+// of stored markdown bodies — the two are unrelated concerns.
+const responseGzipThreshold = 860
+
+// pageCacheSize bounds the in-process LRU of rendered a.html pages.
+const pageCacheSize = 200
+
+// bufferingWriter captures a handler's response so cachingMiddleware
+// can inspect it (to compute an ETag, decide on gzip) before anything
+// reaches the real http.ResponseWriter.
+type bufferingWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferingWriter() *bufferingWriter {
+	return &bufferingWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (b *bufferingWriter) Header() http.Header { return b.header }
+
+func (b *bufferingWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferingWriter) WriteHeader(status int) { b.status = status }
+
+// cachingMiddleware adds ETag/If-None-Match and If-Modified-Since
+// support plus transparent gzip negotiation to any handler. It only
+// acts on GET/HEAD, since caching the response to other methods would
+// be incorrect.
+func cachingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next(w, r)
+			return
+		}
+
+		buf := newBufferingWriter()
+		next(buf, r)
+
+		if buf.status != 0 && buf.status != http.StatusOK {
+			writeBuffered(w, buf)
+			return
+		}
+
+		body := buf.body.Bytes()
+		etag := etagFor(body)
+		buf.header.Set("ETag", etag)
+
+		if strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if isNotModifiedSince(r, buf.header) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		serveBody(w, r, buf.header, body)
+	}
+}
+
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+}
+
+func isNotModifiedSince(r *http.Request, header http.Header) bool {
+	ims := r.Header.Get("If-Modified-Since")
+	lastModified := header.Get("Last-Modified")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveBody writes the header and body to w, gzip-encoding it when
+// the client accepts it and it's large enough to be worth it.
+func serveBody(w http.ResponseWriter, r *http.Request, header http.Header, body []byte) {
+	for k, vs := range header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+
+	if len(body) < responseGzipThreshold || !acceptsGzip(r) {
+		w.Write(body)
+		return
+	}
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write(body)
+	gz.Close()
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Write(b.Bytes())
+}
+
+func writeBuffered(w http.ResponseWriter, buf *bufferingWriter) {
+	for k, vs := range buf.header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(buf.status)
+	w.Write(buf.body.Bytes())
+}
+
+// pageCacheKey identifies a rendered a.html page. Including the ETag
+// means a stale entry is simply never looked up again once an article
+// is edited, rather than needing eager invalidation everywhere.
+// remainingViews is folded in too: burn-after-read articles decrement
+// it on every view without bumping ETag, and a.html renders it, so
+// without this a cached page from the first view would keep being
+// served with the original count long after consumeArticle moved on.
+// It's left zero (and so has no effect on the key) for articles with
+// no view budget.
+type pageCacheKey struct {
+	id             uint64
+	etag           uint64
+	remainingViews int
+}
+
+type pageEntry struct {
+	key  pageCacheKey
+	html []byte
+}
+
+// pageLRU is a small in-process least-recently-used cache of rendered
+// a.html pages, so repeated views of a popular paste skip template
+// execution entirely.
+type pageLRU struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	elements map[pageCacheKey]*list.Element
+}
+
+func newPageLRU(capacity int) *pageLRU {
+	return &pageLRU{
+		capacity: capacity,
+		ll:       list.New(),
+		elements: map[pageCacheKey]*list.Element{},
+	}
+}
+
+func (c *pageLRU) get(key pageCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.elements[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*pageEntry).html, true
+}
+
+func (c *pageLRU) put(key pageCacheKey, html []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elements[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*pageEntry).html = html
+		return
+	}
+	e := c.ll.PushFront(&pageEntry{key: key, html: html})
+	c.elements[key] = e
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.elements, oldest.Value.(*pageEntry).key)
+	}
+}
+
+// invalidateArticle drops every cached page for id, regardless of
+// ETag, so editHandler doesn't need to know which ETag a cached entry
+// might have been stored under.
+func (c *pageLRU) invalidateArticle(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.elements {
+		if key.id == id {
+			c.ll.Remove(e)
+			delete(c.elements, key)
+		}
+	}
+}
+
+var pageCache = newPageLRU(pageCacheSize)
@@ -8,6 +8,7 @@ import (
 	"crypto/sha512"
 	"encoding/gob"
 	"errors"
+	"flag"
 	"fmt"
 	htpl "html/template"
 	"io"
@@ -17,34 +18,42 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/dustin/go-humanize"
 	"github.com/facebookgo/grace/gracehttp"
 	"github.com/golang-commonmark/markdown"
 	"github.com/twinj/uuid"
+	"github.com/xojoc/typed/search"
 	"gitlab.com/xojoc/util"
 )
 
 const (
 	gzipThreshold = 200
 	postLimit     = 30000
+
+	janitorInterval = 5 * time.Minute
 )
 
 var notFound = errors.New("not found")
 
 var boltdb *bolt.DB
+var searchIndex *search.Index
+var articleStore ArticleStore
+
+var storeFlag = flag.String("store", "", "article storage backend: bolt (default), sqlite or memory; overrides TYPED_STORE")
 
 func init() {
 	var err error
 	boltdb, err = bolt.Open("articles.bolt", 0600, nil)
 	util.Fatal(err)
 
-	boltdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("articles"))
-		util.Fatal(err)
-		return nil
-	})
+	searchIndex, err = search.New(boltdb)
+	util.Fatal(err)
+
+	initActivityPub()
 }
 
 func init() {
@@ -66,6 +75,14 @@ type Article struct {
 	Markdown string
 	Gziped   bool
 	ETag     uint64
+
+	// ExpiresAt is the time after which the article is pruned. The
+	// zero value means the article never expires.
+	ExpiresAt time.Time
+	// MaxViews is the number of times the article may be viewed
+	// before it's deleted. Zero means unlimited views.
+	MaxViews       int
+	RemainingViews int
 }
 
 type NetError struct {
@@ -80,38 +97,235 @@ func (a *Article) EditPath() string {
 	return "/edit/" + fmt.Sprint(a.ID)
 }
 
-func getArticleByID(id uint64) (*Article, error) {
+func decodeArticle(v []byte) (*Article, error) {
 	var a Article
-	return &a, boltdb.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("articles"))
-		v := b.Get([]byte(fmt.Sprint(id)))
-		if v == nil {
-			return notFound
-		}
-		dec := gob.NewDecoder(bytes.NewBuffer(v))
-		err := dec.Decode(&a)
+	dec := gob.NewDecoder(bytes.NewBuffer(v))
+	err := dec.Decode(&a)
+	if err != nil {
+		return nil, err
+	}
+	if err := gunzipArticle(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// gunzipArticle reverses the gzip compression newHandler/editHandler
+// apply to a.Markdown when it's at least gzipThreshold bytes, so every
+// ArticleStore backend can hand callers plain Markdown regardless of
+// how the article was stored.
+func gunzipArticle(a *Article) error {
+	if !a.Gziped {
+		return nil
+	}
+	gz, err := gzip.NewReader(strings.NewReader(a.Markdown))
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	a.Markdown = string(b)
+	a.Gziped = false
+	return nil
+}
+
+func getArticleByID(id uint64) (*Article, error) {
+	return articleStore.Get(id)
+}
+
+// isExpired reports whether a has passed its expiration time or has
+// exhausted its view budget.
+func isExpired(a *Article) bool {
+	if !a.ExpiresAt.IsZero() && time.Now().After(a.ExpiresAt) {
+		return true
+	}
+	if a.MaxViews > 0 && a.RemainingViews <= 0 {
+		return true
+	}
+	return false
+}
+
+// isPrivateByExpiry reports whether a is burn-after-read or
+// time-limited, and so should never be broadcast over ActivityPub:
+// delivering it to followers' inboxes or listing it in the public
+// outbox would hand out copies of the content that outlive, and
+// bypass, whatever view/time budget the author set.
+func isPrivateByExpiry(a *Article) bool {
+	return a.MaxViews > 0 || !a.ExpiresAt.IsZero() || isExpired(a)
+}
+
+// parseExpiry parses durations like "10m", "1h", "1d" or "never" (and
+// "") into an absolute expiration time. The zero time means never.
+func parseExpiry(s string) (time.Time, error) {
+	if s == "" || s == "never" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
 		if err != nil {
-			return err
+			return time.Time{}, err
 		}
-		if a.Gziped {
-			gz, err := gzip.NewReader(strings.NewReader(a.Markdown))
-			if err != nil {
-				return err
-			}
-			b, err := ioutil.ReadAll(gz)
-			if err != nil {
+		return time.Now().Add(time.Duration(n) * 24 * time.Hour), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(d), nil
+}
+
+// reindexArticle (re)indexes an article's Markdown in searchIndex.
+func reindexArticle(id uint64, markdown string) error {
+	return boltdb.Update(func(tx *bolt.Tx) error {
+		return searchIndex.IndexArticleTx(tx, id, markdown)
+	})
+}
+
+func deindexArticle(id uint64) error {
+	return boltdb.Update(func(tx *bolt.Tx) error {
+		return searchIndex.RemoveArticleTx(tx, id)
+	})
+}
+
+// putArticleIndexed writes a to articleStore and indexes its Markdown
+// in searchIndex. The search index always lives in bolt, so when the
+// bolt backend is active both writes share its transaction, keeping
+// the guarantee chunk0-2 relies on: the index never observes an
+// article write that didn't also commit, or vice versa. Non-bolt
+// backends keep their article data in a separate database from the
+// bolt-backed index, so that guarantee can't be extended to them; the
+// index write there just follows the store write as closely as
+// possible.
+func putArticleIndexed(a *Article, markdown string) error {
+	if bs, ok := articleStore.(*boltArticleStore); ok {
+		return boltdb.Update(func(tx *bolt.Tx) error {
+			if err := bs.PutTx(tx, a); err != nil {
 				return err
 			}
-			err = gz.Close()
-			if err != nil {
+			return searchIndex.IndexArticleTx(tx, a.ID, markdown)
+		})
+	}
+	if err := articleStore.Put(a); err != nil {
+		return err
+	}
+	return reindexArticle(a.ID, markdown)
+}
+
+// deleteArticleIndexed removes id from articleStore and from
+// searchIndex; see putArticleIndexed for the atomicity guarantee it
+// provides on the bolt backend.
+func deleteArticleIndexed(id uint64) error {
+	if bs, ok := articleStore.(*boltArticleStore); ok {
+		return boltdb.Update(func(tx *bolt.Tx) error {
+			if err := searchIndex.RemoveArticleTx(tx, id); err != nil {
 				return err
 			}
-			a.Markdown = string(b)
-			a.Gziped = false
+			return bs.DeleteTx(tx, id)
+		})
+	}
+	if err := deindexArticle(id); err != nil {
+		return err
+	}
+	return articleStore.Delete(id)
+}
+
+// articleLocks serializes consumeArticle per article ID across all
+// ArticleStore backends, none of which expose a read-modify-write
+// transaction of their own. Without it, two concurrent views of the
+// same burn-after-read article can both Get before either Puts back a
+// decremented RemainingViews, losing a view off the budget. Entries
+// are never removed; that's an unbounded but slow leak bounded by the
+// number of articles ever viewed.
+var (
+	articleLocksMu sync.Mutex
+	articleLocks   = map[uint64]*sync.Mutex{}
+)
+
+func lockArticle(id uint64) func() {
+	articleLocksMu.Lock()
+	mu, ok := articleLocks[id]
+	if !ok {
+		mu = &sync.Mutex{}
+		articleLocks[id] = mu
+	}
+	articleLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// consumeArticle fetches the article for viewing, decrementing its
+// remaining view count when burn-after-read is enabled and deleting
+// it once it has expired or been fully consumed. The view that brings
+// RemainingViews to zero is still served; the article is only gone
+// starting with the next request.
+func consumeArticle(id uint64) (*Article, error) {
+	unlock := lockArticle(id)
+	defer unlock()
+
+	a, err := articleStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(a) {
+		if err := deleteArticleIndexed(id); err != nil {
+			return nil, err
+		}
+		return nil, notFound
+	}
+
+	mutated := false
+	if a.MaxViews > 0 {
+		a.RemainingViews--
+		mutated = true
+	}
+
+	if a.MaxViews > 0 && a.RemainingViews <= 0 {
+		if err := deleteArticleIndexed(id); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	if mutated {
+		if err := articleStore.Put(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// pruneExpiredArticles scans the store and deletes every article
+// that has expired or run out of views, so it doesn't grow unbounded
+// with dead pastes nobody ever re-requests.
+func pruneExpiredArticles() {
+	var dead []uint64
+	err := articleStore.Iterate(func(a *Article) error {
+		if isExpired(a) {
+			dead = append(dead, a.ID)
 		}
-		a.ID = id
 		return nil
 	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, id := range dead {
+		if err := deleteArticleIndexed(id); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func janitor() {
+	t := time.NewTicker(janitorInterval)
+	for range t.C {
+		pruneExpiredArticles()
+	}
 }
 
 func (a *Article) Title() string {
@@ -173,11 +387,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) *NetError {
 		http.Redirect(w, r, "/", http.StatusMovedPermanently)
 		return nil
 	case p == "/":
-		n := 0
-		err := boltdb.View(func(tx *bolt.Tx) error {
-			n = tx.Bucket([]byte("articles")).Stats().KeyN
-			return nil
-		})
+		n, err := articleStore.Count()
 		if err != nil {
 			return &NetError{500, err.Error()}
 		}
@@ -196,6 +406,41 @@ func rootHandler(w http.ResponseWriter, r *http.Request) *NetError {
 	return nil
 }
 
+type searchHit struct {
+	Article *Article
+	Score   float64
+	Snippet htpl.HTML
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	q := r.URL.Query().Get("q")
+	results, err := searchIndex.Query(q)
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+
+	terms := strings.Fields(strings.ToLower(q))
+	hits := make([]searchHit, 0, len(results))
+	for _, res := range results {
+		a, err := getArticleByID(res.ArticleID)
+		if err != nil {
+			continue
+		}
+		md := markdown.New()
+		hits = append(hits, searchHit{
+			Article: a,
+			Score:   res.Score,
+			Snippet: htpl.HTML(md.RenderToString([]byte(search.Snippet(a.Markdown, terms)))),
+		})
+	}
+
+	err = templates.ExecuteTemplate(w, "search.html", hits)
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	return nil
+}
+
 func isCached(r *http.Request, a *Article) bool {
 	for _, s := range r.Header["Cache-Control"] {
 		if s == "max-age=0" {
@@ -215,7 +460,28 @@ func aHandler(w http.ResponseWriter, r *http.Request) *NetError {
 	if err != nil {
 		return &NetError{404, err.Error()}
 	}
-	a, err := getArticleByID(id)
+	// Fediverse servers routinely fetch a paste's canonical Note URL
+	// with Accept: application/activity+json, and that fetch must not
+	// count as a view: going through consumeArticle would burn down
+	// RemainingViews (or delete an already-exhausted article) for a
+	// request nobody actually read. So peek at the article without
+	// consuming it, and still refuse anything private-by-expiry.
+	if wantsActivityJSON(r) {
+		a, err := getArticleByID(id)
+		if err != nil {
+			if err == notFound {
+				return &NetError{404, err.Error()}
+			}
+			return &NetError{500, err.Error()}
+		}
+		if isPrivateByExpiry(a) {
+			return &NetError{404, notFound.Error()}
+		}
+		w.Header().Set("Content-Type", "application/activity+json")
+		return jsonWrite(w, noteForArticle(r, a))
+	}
+
+	a, err := consumeArticle(id)
 	if err != nil {
 		if err == notFound {
 			return &NetError{404, err.Error()}
@@ -224,14 +490,21 @@ func aHandler(w http.ResponseWriter, r *http.Request) *NetError {
 		}
 	}
 	w.Header().Add("Cache-Control", "public, max-age=3600") // one hour
-	//	w.Header().Add("ETag", fmt.Sprintf(`"%d"`, a.ETag))
-	//	if isCached(r, a) {
-	//		return &NetError{304, ""}
-	//	}
-	err = templates.ExecuteTemplate(w, "a.html", a)
-	if err != nil {
+
+	key := pageCacheKey{id: a.ID, etag: a.ETag}
+	if a.MaxViews > 0 {
+		key.remainingViews = a.RemainingViews
+	}
+	if body, ok := pageCache.get(key); ok {
+		w.Write(body)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "a.html", a); err != nil {
 		return &NetError{500, err.Error()}
 	}
+	pageCache.put(key, buf.Bytes())
+	w.Write(buf.Bytes())
 	return nil
 }
 
@@ -253,6 +526,7 @@ func newHandler(w http.ResponseWriter, r *http.Request) *NetError {
 		}
 		g := false
 		m := r.PostForm.Get("newbody")
+		plain := m
 		if len(m) >= gzipThreshold {
 			g = true
 			var b bytes.Buffer
@@ -267,26 +541,36 @@ func newHandler(w http.ResponseWriter, r *http.Request) *NetError {
 			}
 			m = b.String()
 		}
+		expiresAt, err := parseExpiry(r.PostForm.Get("expires"))
+		if err != nil {
+			return &NetError{500, err.Error()}
+		}
+		maxViews := 0
+		if mv := r.PostForm.Get("max_views"); mv != "" {
+			maxViews, err = strconv.Atoi(mv)
+			if err != nil {
+				return &NetError{500, err.Error()}
+			}
+		}
 		var a Article
 		a.Password = p
 		a.Salt = s
 		a.Markdown = m
 		a.Gziped = g
 		a.ETag = 0
-		err := boltdb.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("articles"))
-			a.ID, _ = b.NextSequence()
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			err := enc.Encode(&a)
-			if err != nil {
-				return err
-			}
-			return b.Put([]byte(fmt.Sprint(a.ID)), buf.Bytes())
-		})
+		a.ExpiresAt = expiresAt
+		a.MaxViews = maxViews
+		a.RemainingViews = maxViews
+		a.ID, err = articleStore.NextID()
 		if err != nil {
 			return &NetError{500, err.Error()}
 		}
+		if err := putArticleIndexed(&a, plain); err != nil {
+			return &NetError{500, err.Error()}
+		}
+		if !isPrivateByExpiry(&a) {
+			deliverToFollowers(r, articleCreateActivity(r, &a))
+		}
 		http.Redirect(w, r, a.AbsPath(), http.StatusSeeOther)
 	} else {
 		return &NetError{500, "can't handle verb"}
@@ -344,6 +628,7 @@ func editHandler(w http.ResponseWriter, r *http.Request) *NetError {
 		}
 		g := false
 		m := r.PostForm.Get("newbody")
+		plain := m
 		if len(m) >= gzipThreshold {
 			g = true
 			var b bytes.Buffer
@@ -361,19 +646,10 @@ func editHandler(w http.ResponseWriter, r *http.Request) *NetError {
 		a.Markdown = m
 		a.Gziped = g
 		a.ETag += 1
-		err = boltdb.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("articles"))
-			var buf bytes.Buffer
-			enc := gob.NewEncoder(&buf)
-			err := enc.Encode(&a)
-			if err != nil {
-				return err
-			}
-			return b.Put([]byte(fmt.Sprint(a.ID)), buf.Bytes())
-		})
-		if err != nil {
+		if err := putArticleIndexed(a, plain); err != nil {
 			return &NetError{500, err.Error()}
 		}
+		pageCache.invalidateArticle(a.ID)
 		http.Redirect(w, r, a.AbsPath()+"?etag="+fmt.Sprint(a.ETag), http.StatusSeeOther)
 	} else {
 		return &NetError{500, "can't handle verb"}
@@ -382,13 +658,27 @@ func editHandler(w http.ResponseWriter, r *http.Request) *NetError {
 }
 
 func main() {
+	flag.Parse()
+
 	p := ":4446"
-	if len(os.Args) > 1 {
-		p = os.Args[1]
+	if flag.NArg() > 0 {
+		p = flag.Arg(0)
 	}
-	http.HandleFunc("/", errorHandler(rootHandler))
+
+	store, err := newArticleStore(storeBackend())
+	util.Fatal(err)
+	articleStore = store
+
+	http.HandleFunc("/", cachingMiddleware(errorHandler(rootHandler)))
 	http.Handle("/new", errorHandler(newHandler))
-	http.HandleFunc("/a/", errorHandler(aHandler))
+	http.HandleFunc("/search", cachingMiddleware(errorHandler(searchHandler)))
+	http.HandleFunc("/a/", cachingMiddleware(errorHandler(aHandler)))
 	http.HandleFunc("/edit/", errorHandler(editHandler))
+	http.HandleFunc("/.well-known/webfinger", cachingMiddleware(errorHandler(webfingerHandler)))
+	http.HandleFunc("/actor", cachingMiddleware(errorHandler(actorHandler)))
+	http.HandleFunc("/outbox", cachingMiddleware(errorHandler(outboxHandler)))
+	http.HandleFunc("/inbox", errorHandler(inboxHandler))
+	http.HandleFunc("/import", errorHandler(importHandler))
+	go janitor()
 	gracehttp.Serve(&http.Server{Addr: p})
 }
@@ -0,0 +1,297 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	importMaxBytes = 2 << 20 // 2MiB
+	importTimeout  = 10 * time.Second
+)
+
+// importHTTPClient dials through guardedDialContext so every
+// connection's actual destination IP is checked right before
+// connecting, closing the DNS-rebinding gap a LookupIP-then-Get
+// approach would leave open.
+var importHTTPClient = &http.Client{
+	Timeout: importTimeout,
+	Transport: &http.Transport{
+		DialContext: guardedDialContext,
+	},
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) *NetError {
+	rawurl := r.URL.Query().Get("url")
+	if r.Method == "POST" {
+		r.ParseForm()
+		rawurl = r.PostForm.Get("url")
+	}
+	if rawurl == "" {
+		err := templates.ExecuteTemplate(w, "import.html", nil)
+		if err != nil {
+			return &NetError{500, err.Error()}
+		}
+		return nil
+	}
+
+	body, err := fetchURLGuarded(rawurl)
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+
+	md := cleanMarkdown(nodeToMarkdown(extractMainContent(doc)))
+	err = templates.ExecuteTemplate(w, "form.html", &Article{Markdown: md})
+	if err != nil {
+		return &NetError{500, err.Error()}
+	}
+	return nil
+}
+
+// fetchURLGuarded fetches rawurl, capping the response size and
+// refusing to talk to private/loopback/link-local addresses.
+func fetchURLGuarded(rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported URL scheme")
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := importHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, importMaxBytes))
+}
+
+// guardedDialContext resolves addr itself and only dials IPs that
+// aren't private, loopback or link-local, so the import fetcher
+// can't be pointed at internal services (SSRF).
+func guardedDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			lastErr = fmt.Errorf("refusing to fetch private address %s", ip)
+			continue
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address found for %s", host)
+	}
+	return nil, lastErr
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+var (
+	positiveHints = regexp.MustCompile(`(?i)article|content|post|body|main`)
+	negativeHints = regexp.MustCompile(`(?i)comment|sidebar|footer|nav|ad|banner|related`)
+	skippedTags   = map[string]bool{
+		"script": true, "style": true, "nav": true, "header": true,
+		"footer": true, "aside": true, "form": true,
+	}
+)
+
+// extractMainContent scores every p/div/article/section in doc and
+// returns the highest-scoring subtree, a cheap approximation of
+// Readability's content-extraction heuristic.
+func extractMainContent(doc *html.Node) *html.Node {
+	type candidate struct {
+		node  *html.Node
+		score float64
+	}
+	var candidates []candidate
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && skippedTags[n.Data] {
+			return
+		}
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "p", "div", "article", "section":
+				text := textContent(n)
+				if len(text) > 25 {
+					candidates = append(candidates, candidate{n, scoreNode(n, text)})
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if len(candidates) == 0 {
+		return doc
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.score > best.score {
+			best = c
+		}
+	}
+	return best.node
+}
+
+// scoreNode ranks n by text length, punctuation density (a proxy for
+// actual prose vs. boilerplate) and class/id naming hints.
+func scoreNode(n *html.Node, text string) float64 {
+	score := float64(len(text))
+	score += float64(strings.Count(text, ",")) * 5
+
+	if words := len(strings.Fields(text)); words > 0 {
+		punct := strings.Count(text, ".") + strings.Count(text, "!") + strings.Count(text, "?")
+		score *= 1 + float64(punct)/float64(words)
+	}
+
+	hint := attr(n, "class") + " " + attr(n, "id")
+	if positiveHints.MatchString(hint) {
+		score *= 1.5
+	}
+	if negativeHints.MatchString(hint) {
+		score *= 0.25
+	}
+	return score
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+			return
+		}
+		if n.Type == html.ElementNode && skippedTags[n.Data] {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return buf.String()
+}
+
+var multiBlankLine = regexp.MustCompile(`\n{3,}`)
+
+func cleanMarkdown(s string) string {
+	return strings.TrimSpace(multiBlankLine.ReplaceAllString(s, "\n\n"))
+}
+
+// nodeToMarkdown renders the surviving subtree as Markdown, handling
+// just the elements that typically carry article prose.
+func nodeToMarkdown(n *html.Node) string {
+	var buf strings.Builder
+	renderMarkdown(n, &buf, 0)
+	return buf.String()
+}
+
+func renderMarkdown(n *html.Node, buf *strings.Builder, listDepth int) {
+	if n.Type == html.TextNode {
+		buf.WriteString(n.Data)
+		return
+	}
+	if n.Type != html.ElementNode {
+		renderChildren(n, buf, listDepth)
+		return
+	}
+	if skippedTags[n.Data] {
+		return
+	}
+
+	switch n.Data {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		buf.WriteString("\n" + strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("\n\n")
+	case "p":
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("\n\n")
+	case "br":
+		buf.WriteString("\n")
+	case "strong", "b":
+		buf.WriteString("**")
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("**")
+	case "em", "i":
+		buf.WriteString("*")
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("*")
+	case "a":
+		buf.WriteString("[")
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("](" + attr(n, "href") + ")")
+	case "li":
+		buf.WriteString(strings.Repeat("  ", listDepth) + "- ")
+		renderChildren(n, buf, listDepth)
+		buf.WriteString("\n")
+	case "ul", "ol":
+		renderChildren(n, buf, listDepth+1)
+		buf.WriteString("\n")
+	default:
+		renderChildren(n, buf, listDepth)
+	}
+}
+
+func renderChildren(n *html.Node, buf *strings.Builder, listDepth int) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderMarkdown(c, buf, listDepth)
+	}
+}
@@ -0,0 +1,394 @@
+// Written by http://xojoc.pw. Public Domain.
+
+// Package search implements a small BM25 full-text index over the
+// Markdown content of stored articles, persisted in its own bolt
+// buckets alongside the articles bucket.
+package search
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	indexBucket    = "search_index"
+	metaBucket     = "search_meta"
+	docLenBucket   = "search_doclen"
+	docTermsBucket = "search_doc_terms"
+
+	docCountKey = "doc_count"
+	totalLenKey = "total_len"
+
+	k1 = 1.2
+	b  = 0.75
+)
+
+// Posting records one article's occurrences of a term: how many
+// times it appears and at which token positions, so phrase queries
+// can check adjacency without re-tokenizing the article.
+type Posting struct {
+	ArticleID     uint64
+	TermFrequency int
+	Positions     []int
+}
+
+// Index is a BM25 full-text index backed by bolt. The zero value is
+// not usable; create one with New.
+type Index struct {
+	db *bolt.DB
+}
+
+// New opens (creating if necessary) the buckets the index needs in
+// db and returns an Index ready for use.
+func New(db *bolt.DB) (*Index, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{indexBucket, metaBucket, docLenBucket, docTermsBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+// Result is one ranked hit from Query.
+type Result struct {
+	ArticleID uint64
+	Score     float64
+}
+
+// IndexArticleTx (re)indexes the article id's Markdown content. It
+// must be called inside the same bolt.Update transaction that writes
+// the article itself, so the index never observes a partially
+// written article. Calling it again for an id that was already
+// indexed removes the old postings first.
+func (ix *Index) IndexArticleTx(tx *bolt.Tx, id uint64, markdown string) error {
+	_, existed, err := ix.removeArticleTx(tx, id)
+	if err != nil {
+		return err
+	}
+
+	tokens := tokenize(markdown)
+	positions := map[string][]int{}
+	for pos, t := range tokens {
+		positions[t] = append(positions[t], pos)
+	}
+
+	ib := tx.Bucket([]byte(indexBucket))
+	terms := make([]string, 0, len(positions))
+	for term, pos := range positions {
+		terms = append(terms, term)
+		postings, err := loadPostings(ib, term)
+		if err != nil {
+			return err
+		}
+		postings = append(postings, Posting{ArticleID: id, TermFrequency: len(pos), Positions: pos})
+		if err := storePostings(ib, term, postings); err != nil {
+			return err
+		}
+	}
+
+	if err := putGob(tx.Bucket([]byte(docTermsBucket)), id, terms); err != nil {
+		return err
+	}
+	if err := putUint(tx.Bucket([]byte(docLenBucket)), id, uint64(len(tokens))); err != nil {
+		return err
+	}
+
+	mb := tx.Bucket([]byte(metaBucket))
+	if err := addMetaCounter(mb, totalLenKey, int64(len(tokens))); err != nil {
+		return err
+	}
+	if !existed {
+		return addMetaCounter(mb, docCountKey, 1)
+	}
+	return nil
+}
+
+// RemoveArticleTx removes id's postings from the index. It must run
+// inside the same transaction that deletes the article.
+func (ix *Index) RemoveArticleTx(tx *bolt.Tx, id uint64) error {
+	_, existed, err := ix.removeArticleTx(tx, id)
+	if err != nil || !existed {
+		return err
+	}
+	return addMetaCounter(tx.Bucket([]byte(metaBucket)), docCountKey, -1)
+}
+
+// removeArticleTx strips id out of every posting list it appears in,
+// subtracts the document length it used to have from total_len, and
+// returns that length.
+func (ix *Index) removeArticleTx(tx *bolt.Tx, id uint64) (oldLen int, existed bool, err error) {
+	tb := tx.Bucket([]byte(docTermsBucket))
+	key := idKey(id)
+	v := tb.Get(key)
+	if v == nil {
+		return 0, false, nil
+	}
+	var terms []string
+	if err := gobDecode(v, &terms); err != nil {
+		return 0, false, err
+	}
+
+	ib := tx.Bucket([]byte(indexBucket))
+	for _, term := range terms {
+		postings, err := loadPostings(ib, term)
+		if err != nil {
+			return 0, false, err
+		}
+		kept := postings[:0]
+		for _, p := range postings {
+			if p.ArticleID != id {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			if err := ib.Delete([]byte(term)); err != nil {
+				return 0, false, err
+			}
+		} else if err := storePostings(ib, term, kept); err != nil {
+			return 0, false, err
+		}
+	}
+
+	lb := tx.Bucket([]byte(docLenBucket))
+	if lv := lb.Get(key); lv != nil {
+		oldLen = int(binary.BigEndian.Uint64(lv))
+	}
+	if err := lb.Delete(key); err != nil {
+		return 0, false, err
+	}
+	if err := tb.Delete(key); err != nil {
+		return 0, false, err
+	}
+	if err := addMetaCounter(tx.Bucket([]byte(metaBucket)), totalLenKey, -int64(oldLen)); err != nil {
+		return 0, false, err
+	}
+
+	return oldLen, true, nil
+}
+
+// Query runs a BM25-ranked search for q and returns hits sorted by
+// score, highest first. Wrapping q in double quotes restricts results
+// to articles where the terms appear as a consecutive phrase.
+func (ix *Index) Query(q string) ([]Result, error) {
+	q = strings.TrimSpace(q)
+	phrase := strings.HasPrefix(q, `"`) && strings.HasSuffix(q, `"`) && len(q) > 1
+	terms := tokenize(strings.Trim(q, `"`))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var results []Result
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(metaBucket))
+		docCount := getCounter(mb, docCountKey)
+		totalLen := getCounter(mb, totalLenKey)
+		if docCount == 0 {
+			return nil
+		}
+		avgdl := float64(totalLen) / float64(docCount)
+
+		ib := tx.Bucket([]byte(indexBucket))
+		lb := tx.Bucket([]byte(docLenBucket))
+
+		postingsByTerm := make(map[string][]Posting, len(terms))
+		scores := map[uint64]float64{}
+		for _, term := range terms {
+			postings, err := loadPostings(ib, term)
+			if err != nil {
+				return err
+			}
+			postingsByTerm[term] = postings
+			df := len(postings)
+			if df == 0 {
+				continue
+			}
+			idf := math.Log(float64(docCount)-float64(df)+0.5) - math.Log(float64(df)+0.5) + 1
+			for _, p := range postings {
+				var dl float64
+				if lv := lb.Get(idKey(p.ArticleID)); lv != nil {
+					dl = float64(binary.BigEndian.Uint64(lv))
+				}
+				tf := float64(p.TermFrequency)
+				scores[p.ArticleID] += idf * (tf * (k1 + 1)) / (tf + k1*(1-b+b*dl/avgdl))
+			}
+		}
+
+		if phrase && len(terms) > 1 {
+			scores = filterPhraseMatches(scores, postingsByTerm, terms)
+		}
+
+		results = make([]Result, 0, len(scores))
+		for id, score := range scores {
+			results = append(results, Result{ArticleID: id, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// filterPhraseMatches keeps only the documents where every query term
+// occurs at consecutive positions, using the positions recorded in
+// each term's posting list.
+func filterPhraseMatches(scores map[uint64]float64, postingsByTerm map[string][]Posting, terms []string) map[uint64]float64 {
+	positionsByDoc := make(map[uint64][][]int)
+	for _, term := range terms {
+		for _, p := range postingsByTerm[term] {
+			positionsByDoc[p.ArticleID] = append(positionsByDoc[p.ArticleID], p.Positions)
+		}
+	}
+
+	filtered := map[uint64]float64{}
+	for id, score := range scores {
+		lists := positionsByDoc[id]
+		if len(lists) == len(terms) && hasConsecutiveRun(lists) {
+			filtered[id] = score
+		}
+	}
+	return filtered
+}
+
+// hasConsecutiveRun reports whether there's a starting position p
+// such that lists[0] contains p, lists[1] contains p+1, and so on.
+func hasConsecutiveRun(lists [][]int) bool {
+	if len(lists) == 0 {
+		return false
+	}
+	for _, start := range lists[0] {
+		match := true
+		for i := 1; i < len(lists); i++ {
+			if !containsInt(lists[i], start+i) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(xs []int, v int) bool {
+	for _, x := range xs {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+const snippetRadius = 80
+
+// Snippet extracts a short excerpt of text around the earliest
+// occurrence of any word in terms, wrapping every match with markdown emphasis
+// so it renders highlighted wherever the excerpt is displayed.
+func Snippet(text string, terms []string) string {
+	if len(terms) == 0 {
+		return ""
+	}
+	lower := strings.ToLower(text)
+	start := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i != -1 && (start == -1 || i < start) {
+			start = i
+		}
+	}
+	if start == -1 {
+		start = 0
+	}
+	from := start - snippetRadius
+	if from < 0 {
+		from = 0
+	}
+	to := start + snippetRadius
+	if to > len(text) {
+		to = len(text)
+	}
+	excerpt := text[from:to]
+
+	for _, t := range terms {
+		re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(t))
+		excerpt = re.ReplaceAllStringFunc(excerpt, func(m string) string {
+			return "**" + m + "**"
+		})
+	}
+	return excerpt
+}
+
+func loadPostings(bkt *bolt.Bucket, term string) ([]Posting, error) {
+	v := bkt.Get([]byte(term))
+	if v == nil {
+		return nil, nil
+	}
+	var postings []Posting
+	if err := gobDecode(v, &postings); err != nil {
+		return nil, err
+	}
+	return postings, nil
+}
+
+func storePostings(bkt *bolt.Bucket, term string, postings []Posting) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(postings); err != nil {
+		return err
+	}
+	return bkt.Put([]byte(term), buf.Bytes())
+}
+
+func gobDecode(v []byte, out interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(v)).Decode(out)
+}
+
+func putGob(bkt *bolt.Bucket, id uint64, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return bkt.Put(idKey(id), buf.Bytes())
+}
+
+func putUint(bkt *bolt.Bucket, id uint64, n uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return bkt.Put(idKey(id), v)
+}
+
+func idKey(id uint64) []byte {
+	return []byte(fmt.Sprint(id))
+}
+
+func getCounter(bkt *bolt.Bucket, key string) uint64 {
+	v := bkt.Get([]byte(key))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func addMetaCounter(bkt *bolt.Bucket, key string, delta int64) error {
+	cur := int64(getCounter(bkt, key)) + delta
+	if cur < 0 {
+		cur = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(cur))
+	return bkt.Put([]byte(key), v)
+}
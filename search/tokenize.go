@@ -0,0 +1,54 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package search
+
+import (
+	"regexp"
+	"strings"
+)
+
+var tokenRe = regexp.MustCompile(`[a-z0-9]+`)
+
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true,
+	"at": true, "be": true, "by": true, "for": true, "from": true,
+	"in": true, "is": true, "it": true, "of": true, "on": true,
+	"or": true, "that": true, "the": true, "this": true, "to": true,
+	"was": true, "were": true, "with": true,
+}
+
+// tokenize lowercases s, splits it into words, drops stopwords and
+// stems what's left so that "pastes" and "paste" index to the same
+// term.
+func tokenize(s string) []string {
+	words := tokenRe.FindAllString(strings.ToLower(s), -1)
+	tokens := make([]string, 0, len(words))
+	for _, w := range words {
+		if stopwords[w] {
+			continue
+		}
+		tokens = append(tokens, stem(w))
+	}
+	return tokens
+}
+
+// stem applies a light suffix-stripping stem. It's not a full Porter
+// stemmer, just enough to fold common plural and verb endings (and a
+// trailing "e") together for matching purposes.
+func stem(w string) string {
+	switch {
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ing") && len(w) > 5:
+		return w[:len(w)-3]
+	case strings.HasSuffix(w, "ed") && len(w) > 4:
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "es") && len(w) > 4:
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "s") && len(w) > 3 && !strings.HasSuffix(w, "ss"):
+		return w[:len(w)-1]
+	case strings.HasSuffix(w, "e") && len(w) > 3:
+		return w[:len(w)-1]
+	}
+	return w
+}
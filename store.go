@@ -0,0 +1,51 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ArticleStore persists Article values behind a storage-agnostic
+// interface, so the HTTP handlers can run against bolt, SQLite or an
+// in-memory store without changing a line of handler code.
+type ArticleStore interface {
+	Get(id uint64) (*Article, error)
+	Put(a *Article) error
+	NextID() (uint64, error)
+	Delete(id uint64) error
+	Iterate(func(*Article) error) error
+	Count() (int, error)
+}
+
+// storeBackend resolves the article storage backend to use: the
+// -store flag takes precedence, then TYPED_STORE, then the bolt
+// default.
+func storeBackend() string {
+	if *storeFlag != "" {
+		return *storeFlag
+	}
+	if v := os.Getenv("TYPED_STORE"); v != "" {
+		return v
+	}
+	return "bolt"
+}
+
+// newArticleStore builds the ArticleStore for the named backend.
+func newArticleStore(backend string) (ArticleStore, error) {
+	switch backend {
+	case "bolt":
+		return newBoltArticleStore(boltdb)
+	case "sqlite":
+		dsn := os.Getenv("TYPED_SQLITE_DSN")
+		if dsn == "" {
+			dsn = "typed.sqlite3"
+		}
+		return newSQLiteArticleStore(dsn)
+	case "memory":
+		return newMemoryArticleStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
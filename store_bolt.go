@@ -0,0 +1,118 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+const articlesBucket = "articles"
+
+// boltArticleStore is the default ArticleStore, backed by the same
+// bolt database as the rest of typed's storage.
+type boltArticleStore struct {
+	db *bolt.DB
+}
+
+func newBoltArticleStore(db *bolt.DB) (*boltArticleStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(articlesBucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltArticleStore{db: db}, nil
+}
+
+func (s *boltArticleStore) Get(id uint64) (*Article, error) {
+	var a *Article
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(articlesBucket)).Get([]byte(fmt.Sprint(id)))
+		if v == nil {
+			return notFound
+		}
+		var err error
+		a, err = decodeArticle(v)
+		if err != nil {
+			return err
+		}
+		a.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *boltArticleStore) Put(a *Article) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.PutTx(tx, a)
+	})
+}
+
+// PutTx is the Put logic factored out so callers that also need to
+// update the bolt-backed search index can write the article and its
+// postings inside a single transaction.
+func (s *boltArticleStore) PutTx(tx *bolt.Tx, a *Article) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(a); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(articlesBucket)).Put([]byte(fmt.Sprint(a.ID)), buf.Bytes())
+}
+
+func (s *boltArticleStore) NextID() (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = tx.Bucket([]byte(articlesBucket)).NextSequence()
+		return err
+	})
+	return id, err
+}
+
+func (s *boltArticleStore) Delete(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.DeleteTx(tx, id)
+	})
+}
+
+// DeleteTx is the Delete logic factored out so callers that also need
+// to update the bolt-backed search index can delete the article and
+// its postings inside a single transaction.
+func (s *boltArticleStore) DeleteTx(tx *bolt.Tx, id uint64) error {
+	return tx.Bucket([]byte(articlesBucket)).Delete([]byte(fmt.Sprint(id)))
+}
+
+func (s *boltArticleStore) Iterate(fn func(*Article) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(articlesBucket)).ForEach(func(k, v []byte) error {
+			a, err := decodeArticle(v)
+			if err != nil {
+				return err
+			}
+			id, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			a.ID = id
+			return fn(a)
+		})
+	})
+}
+
+func (s *boltArticleStore) Count() (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(articlesBucket)).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,82 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+import "sync"
+
+// memoryArticleStore is a map-backed ArticleStore with no
+// persistence. It backs the "memory" storage flag. Only the articles
+// themselves are kept in memory: the search index and the ActivityPub
+// keys and followers still live in the bolt database that init opens,
+// so the HTTP handlers still write to disk with this store.
+type memoryArticleStore struct {
+	mu       sync.Mutex
+	articles map[uint64]*Article
+	nextID   uint64
+}
+
+func newMemoryArticleStore() *memoryArticleStore {
+	return &memoryArticleStore{articles: map[uint64]*Article{}}
+}
+
+func (s *memoryArticleStore) Get(id uint64) (*Article, error) {
+	s.mu.Lock()
+	a, ok := s.articles[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, notFound
+	}
+	cp := *a
+	s.mu.Unlock()
+	if err := gunzipArticle(&cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func (s *memoryArticleStore) Put(a *Article) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *a
+	s.articles[a.ID] = &cp
+	return nil
+}
+
+func (s *memoryArticleStore) NextID() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return s.nextID, nil
+}
+
+func (s *memoryArticleStore) Delete(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.articles, id)
+	return nil
+}
+
+func (s *memoryArticleStore) Iterate(fn func(*Article) error) error {
+	s.mu.Lock()
+	articles := make([]*Article, 0, len(s.articles))
+	for _, a := range s.articles {
+		cp := *a
+		articles = append(articles, &cp)
+	}
+	s.mu.Unlock()
+	for _, a := range articles {
+		if err := gunzipArticle(a); err != nil {
+			return err
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryArticleStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.articles), nil
+}
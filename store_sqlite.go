@@ -0,0 +1,170 @@
+// Written by http://xojoc.pw. Public Domain.
+
+package main
+
+// The sqlite backend needs a binary built with the sqlite_fts5 build
+// tag (go build -tags sqlite_fts5 ...): github.com/mattn/go-sqlite3
+// only compiles in FTS5 support when that tag is set, and articles_fts
+// below is an FTS5 virtual table. This file has no build constraint,
+// so it also compiles without the tag; newSQLiteArticleStore then
+// fails when it creates articles_fts.
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteArticleStore persists articles in a SQLite database, with an
+// FTS5 virtual table kept in sync on every write so the "sqlite"
+// backend has full-text search available on its own, independent of
+// the bolt-backed search index used by the rest of typed.
+type sqliteArticleStore struct {
+	db *sql.DB
+}
+
+func newSQLiteArticleStore(dsn string) (*sqliteArticleStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+CREATE TABLE IF NOT EXISTS articles (
+	id INTEGER PRIMARY KEY,
+	password TEXT,
+	salt TEXT,
+	markdown TEXT,
+	gziped INTEGER,
+	etag INTEGER,
+	expires_at DATETIME,
+	max_views INTEGER,
+	remaining_views INTEGER
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS articles_fts USING fts5(markdown, content='articles', content_rowid='id');
+`)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteArticleStore{db: db}, nil
+}
+
+func (s *sqliteArticleStore) Get(id uint64) (*Article, error) {
+	row := s.db.QueryRow(`SELECT id, password, salt, markdown, gziped, etag, expires_at, max_views, remaining_views FROM articles WHERE id = ?`, id)
+	a, err := scanArticle(row)
+	if err == sql.ErrNoRows {
+		return nil, notFound
+	}
+	return a, err
+}
+
+func (s *sqliteArticleStore) Put(a *Article) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+INSERT INTO articles (id, password, salt, markdown, gziped, etag, expires_at, max_views, remaining_views)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	password = excluded.password,
+	salt = excluded.salt,
+	markdown = excluded.markdown,
+	gziped = excluded.gziped,
+	etag = excluded.etag,
+	expires_at = excluded.expires_at,
+	max_views = excluded.max_views,
+	remaining_views = excluded.remaining_views`,
+		a.ID, a.Password, a.Salt, a.Markdown, a.Gziped, a.ETag, nullableTime(a.ExpiresAt), a.MaxViews, a.RemainingViews)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// articles_fts is an external-content FTS5 table, which doesn't
+	// support UPSERT; delete-then-insert is the documented way to
+	// keep it in sync with an update to the backing row.
+	if _, err = tx.Exec(`DELETE FROM articles_fts WHERE rowid = ?`, a.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(`INSERT INTO articles_fts(rowid, markdown) VALUES (?, ?)`, a.ID, a.Markdown); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteArticleStore) NextID() (uint64, error) {
+	var id uint64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM articles`).Scan(&id)
+	return id, err
+}
+
+func (s *sqliteArticleStore) Delete(id uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM articles_fts WHERE rowid = ?`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM articles WHERE id = ?`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteArticleStore) Iterate(fn func(*Article) error) error {
+	rows, err := s.db.Query(`SELECT id, password, salt, markdown, gziped, etag, expires_at, max_views, remaining_views FROM articles`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanArticle(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteArticleStore) Count() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM articles`).Scan(&n)
+	return n, err
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows, so
+// scanArticle can back both Get and Iterate.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanArticle(row rowScanner) (*Article, error) {
+	var a Article
+	var expiresAt sql.NullTime
+	err := row.Scan(&a.ID, &a.Password, &a.Salt, &a.Markdown, &a.Gziped, &a.ETag, &expiresAt, &a.MaxViews, &a.RemainingViews)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		a.ExpiresAt = expiresAt.Time
+	}
+	if err := gunzipArticle(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}